@@ -0,0 +1,99 @@
+// csi-scaleio starts the ScaleIO storage plugin. Running with no
+// arguments starts the CSI gRPC Node endpoint on $CSI_ENDPOINT, as
+// expected by container orchestrators speaking CSI; "serve docker"
+// instead starts the Docker Volume Plugin HTTP endpoint, for hosts that
+// run plain Docker rather than Kubernetes/CSI.
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+
+	"github.com/thecodeteam/csi-scaleio/service"
+	"github.com/thecodeteam/csi-scaleio/service/dockerplugin"
+)
+
+func main() {
+	if len(os.Args) >= 3 && os.Args[1] == "serve" && os.Args[2] == "docker" {
+		if err := serveDocker(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if err := serveCSI(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// serveCSI starts the CSI Node gRPC endpoint on the Unix socket named by
+// $CSI_ENDPOINT, as container orchestrators expect.
+func serveCSI() error {
+	privDir := envOrDefault("X_CSI_SCALEIO_PRIVDIR", "/var/lib/csi-scaleio/private")
+	if err := os.MkdirAll(privDir, 0755); err != nil {
+		return err
+	}
+
+	mgr, err := newScaleIOVolumeManager()
+	if err != nil {
+		return err
+	}
+
+	l, err := listen(envOrDefault("CSI_ENDPOINT", "unix:///var/run/csi-scaleio.sock"))
+	if err != nil {
+		return err
+	}
+
+	server := grpc.NewServer()
+	csi.RegisterNodeServer(server, service.New(privDir, mgr))
+
+	log.WithField("endpoint", l.Addr().String()).Info("csi-scaleio node service listening")
+	return server.Serve(l)
+}
+
+// listen parses a CSI_ENDPOINT value of the form "scheme://address" and
+// binds a listener to it. CSI endpoints are conventionally Unix sockets.
+func listen(endpoint string) (net.Listener, error) {
+	parts := strings.SplitN(endpoint, "://", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid endpoint: %s", endpoint)
+	}
+	scheme, addr := parts[0], parts[1]
+	if scheme == "unix" {
+		os.Remove(addr)
+	}
+	return net.Listen(scheme, addr)
+}
+
+func serveDocker() error {
+	privDir := envOrDefault("X_CSI_SCALEIO_PRIVDIR", "/var/lib/csi-scaleio/private")
+	root := envOrDefault("X_CSI_SCALEIO_DOCKER_ROOT", "/var/lib/csi-scaleio/docker")
+
+	if err := os.MkdirAll(privDir, 0755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return err
+	}
+
+	mgr, err := newScaleIOVolumeManager()
+	if err != nil {
+		return err
+	}
+
+	p := dockerplugin.New(mgr, privDir, root)
+	return p.Serve("csi-scaleio")
+}
+
+func envOrDefault(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
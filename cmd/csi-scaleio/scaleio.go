@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/thecodeteam/goscaleio"
+
+	"github.com/thecodeteam/csi-scaleio/service/dockerplugin"
+)
+
+// scaleIOVolumeManager adapts the goscaleio REST client, already used by
+// the CSI controller service, to the dockerplugin.VolumeManager
+// interface needed to back the Docker Volume Plugin endpoint.
+type scaleIOVolumeManager struct {
+	system      *goscaleio.System
+	pool        *goscaleio.StoragePool
+	storagePool string
+}
+
+func newScaleIOVolumeManager() (dockerplugin.VolumeManager, error) {
+	endpoint := os.Getenv("X_CSI_SCALEIO_ENDPOINT")
+	if endpoint == "" {
+		return nil, fmt.Errorf("X_CSI_SCALEIO_ENDPOINT is required")
+	}
+
+	client, err := goscaleio.NewClientWithArgs(endpoint, "", true, false)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := client.Authenticate(&goscaleio.ConfigConnect{
+		Endpoint: endpoint,
+		Username: os.Getenv("X_CSI_SCALEIO_USER"),
+		Password: os.Getenv("X_CSI_SCALEIO_PASSWORD"),
+	}); err != nil {
+		return nil, err
+	}
+
+	system, err := client.FindSystem(
+		os.Getenv("X_CSI_SCALEIO_SYSTEMID"), os.Getenv("X_CSI_SCALEIO_SYSTEMNAME"), "")
+	if err != nil {
+		return nil, err
+	}
+
+	storagePool := os.Getenv("X_CSI_SCALEIO_STORAGEPOOL")
+	pool, err := system.FindStoragePool("", storagePool, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return &scaleIOVolumeManager{
+		system:      system,
+		pool:        pool,
+		storagePool: storagePool,
+	}, nil
+}
+
+func (m *scaleIOVolumeManager) CreateVolume(
+	ctx context.Context, name string, opts map[string]string) (string, error) {
+
+	pool := m.pool
+	if sp := opts["storagePool"]; sp != "" && sp != m.storagePool {
+		var err error
+		if pool, err = m.system.FindStoragePool("", sp, ""); err != nil {
+			return "", err
+		}
+	}
+
+	vol, err := pool.CreateVolume(name, opts["size"], opts["thin"] != "false")
+	if err != nil {
+		return "", err
+	}
+	return vol.ID, nil
+}
+
+func (m *scaleIOVolumeManager) RemoveVolume(ctx context.Context, id string) error {
+	vol, err := m.system.GetVolume(id)
+	if err != nil {
+		return err
+	}
+	return vol.RemoveVolume("ONLY_ME")
+}
+
+func (m *scaleIOVolumeManager) VolumeIDByName(ctx context.Context, name string) (string, error) {
+	vol, err := m.system.FindVolume(name)
+	if err != nil {
+		return "", err
+	}
+	return vol.ID, nil
+}
+
+func (m *scaleIOVolumeManager) AttachVolume(ctx context.Context, id string) (string, error) {
+	vol, err := m.system.GetVolume(id)
+	if err != nil {
+		return "", err
+	}
+	return vol.MapToSDC()
+}
+
+func (m *scaleIOVolumeManager) DetachVolume(ctx context.Context, id string) error {
+	vol, err := m.system.GetVolume(id)
+	if err != nil {
+		return err
+	}
+	return vol.UnmapFromSDC()
+}
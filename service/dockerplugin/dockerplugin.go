@@ -0,0 +1,90 @@
+// Package dockerplugin serves the ScaleIO driver over the Docker Volume
+// Plugin HTTP API (https://docs.docker.com/engine/extend/plugins_volume/),
+// so that hosts running plain Docker can use the same ScaleIO plugin code
+// as the CSI node service without running a CSI sidecar stack.
+package dockerplugin
+
+import (
+	"context"
+	"sync"
+)
+
+// VolumeManager is the subset of ScaleIO volume lifecycle operations that
+// the Docker Volume Plugin adapter needs in order to translate Docker's
+// Create/Remove/Mount/Unmount calls into ScaleIO operations. The
+// csi-scaleio command implements it with an adapter around the goscaleio
+// REST client.
+type VolumeManager interface {
+	// CreateVolume creates a new ScaleIO volume and returns its ID.
+	CreateVolume(ctx context.Context, name string, opts map[string]string) (id string, err error)
+	// RemoveVolume deletes the ScaleIO volume with the given ID.
+	RemoveVolume(ctx context.Context, id string) error
+	// VolumeIDByName looks up the ScaleIO volume ID for a Docker volume
+	// name, returning an empty string if no such volume exists.
+	VolumeIDByName(ctx context.Context, name string) (id string, err error)
+	// AttachVolume maps the ScaleIO volume to this node via the SDC and
+	// returns the local block device path.
+	AttachVolume(ctx context.Context, id string) (device string, err error)
+	// DetachVolume unmaps the ScaleIO volume from this node's SDC.
+	DetachVolume(ctx context.Context, id string) error
+}
+
+// volume tracks the local state the plugin keeps for a Docker-named
+// volume: the backing ScaleIO ID, the device it's attached to, and which
+// container IDs currently hold a Mount reference on it. Docker issues one
+// Mount/Unmount pair per container that uses the volume, so a volume used
+// by two containers is mounted once and refcounted twice. mu serializes
+// Mount/Unmount for this volume specifically, so the slow SDC attach/
+// detach and mount I/O for one volume doesn't block unrelated volumes.
+type volume struct {
+	mu     sync.Mutex
+	id     string
+	device string
+	mounts map[string]int
+}
+
+// Plugin adapts the ScaleIO driver to the Docker Volume Plugin API.
+type Plugin struct {
+	mgr     VolumeManager
+	privDir string
+	root    string
+
+	mu      sync.Mutex
+	volumes map[string]*volume
+}
+
+// New returns a Plugin backed by mgr. privDir is the directory used for
+// the private per-device mounts shared with the CSI node service, and
+// root is the plugin-owned directory under which per-volume target mount
+// points are created for Docker.
+func New(mgr VolumeManager, privDir, root string) *Plugin {
+	return &Plugin{
+		mgr:     mgr,
+		privDir: privDir,
+		root:    root,
+		volumes: map[string]*volume{},
+	}
+}
+
+func (p *Plugin) getOrCreateVolume(name string) *volume {
+	v, ok := p.volumes[name]
+	if !ok {
+		v = &volume{mounts: map[string]int{}}
+		p.volumes[name] = v
+	}
+	return v
+}
+
+// lockVolume returns name's volume record, creating it if needed, locked
+// for the caller's exclusive use. Looking the record up is the only part
+// done under p.mu, so that Mount/Unmount calls for different volumes
+// don't serialize on each other while one of them is blocked on slow SDC
+// or mount I/O.
+func (p *Plugin) lockVolume(name string) *volume {
+	p.mu.Lock()
+	v := p.getOrCreateVolume(name)
+	p.mu.Unlock()
+
+	v.mu.Lock()
+	return v
+}
@@ -0,0 +1,34 @@
+package dockerplugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetOrCreateVolumeReusesRecord(t *testing.T) {
+	p := &Plugin{volumes: map[string]*volume{}}
+
+	v1 := p.getOrCreateVolume("vol-1")
+	v2 := p.getOrCreateVolume("vol-1")
+
+	assert.Same(t, v1, v2)
+}
+
+func TestLockVolumeRefcounting(t *testing.T) {
+	p := &Plugin{volumes: map[string]*volume{}}
+
+	v := p.lockVolume("vol-1")
+	v.mounts["container-a"]++
+	v.mounts["container-b"]++
+	v.mu.Unlock()
+
+	assert.Len(t, v.mounts, 2)
+
+	v = p.lockVolume("vol-1")
+	delete(v.mounts, "container-a")
+	v.mu.Unlock()
+
+	assert.Len(t, v.mounts, 1)
+	assert.Contains(t, v.mounts, "container-b")
+}
@@ -0,0 +1,246 @@
+package dockerplugin
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// contentType is the content type required by the Docker Volume Plugin
+// API for every request and response body.
+const contentType = "application/vnd.docker.plugins.v1.1+json"
+
+// socketDir is the well-known directory Docker scans for plugin sockets.
+const socketDir = "/run/docker/plugins"
+
+// Serve listens on a Unix socket named name under socketDir and serves
+// the Docker Volume Plugin API. It blocks until http.Serve returns and
+// passes on its error; there is no way to stop it from outside.
+func (p *Plugin) Serve(name string) error {
+	if err := os.MkdirAll(socketDir, 0755); err != nil {
+		return err
+	}
+	socketPath := socketDir + "/" + name + ".sock"
+	os.Remove(socketPath)
+
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(socketPath, 0660); err != nil {
+		l.Close()
+		return err
+	}
+
+	log.WithField("socket", socketPath).Info("docker volume plugin listening")
+	return http.Serve(l, p.handler())
+}
+
+func (p *Plugin) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Plugin.Activate", p.handleActivate)
+	mux.HandleFunc("/VolumeDriver.Create", p.handleCreate)
+	mux.HandleFunc("/VolumeDriver.Remove", p.handleRemove)
+	mux.HandleFunc("/VolumeDriver.Mount", p.handleMount)
+	mux.HandleFunc("/VolumeDriver.Path", p.handlePath)
+	mux.HandleFunc("/VolumeDriver.Unmount", p.handleUnmount)
+	mux.HandleFunc("/VolumeDriver.Get", p.handleGet)
+	mux.HandleFunc("/VolumeDriver.List", p.handleList)
+	mux.HandleFunc("/VolumeDriver.Capabilities", p.handleCapabilities)
+	return mux
+}
+
+type createRequest struct {
+	Name string
+	Opts map[string]string
+}
+
+type nameRequest struct {
+	Name string
+}
+
+type mountRequest struct {
+	Name string
+	ID   string
+}
+
+type errorResponse struct {
+	Err string
+}
+
+type pathResponse struct {
+	Mountpoint string
+	Err        string `json:",omitempty"`
+}
+
+type volumeInfo struct {
+	Name       string
+	Mountpoint string `json:",omitempty"`
+}
+
+type getResponse struct {
+	Volume *volumeInfo
+	Err    string `json:",omitempty"`
+}
+
+type listResponse struct {
+	Volumes []*volumeInfo
+	Err     string `json:",omitempty"`
+}
+
+type capabilitiesResponse struct {
+	Capabilities struct {
+		Scope string
+	}
+}
+
+func decode(r *http.Request, v interface{}) error {
+	defer r.Body.Close()
+	return json.NewDecoder(r.Body).Decode(v)
+}
+
+func respond(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", contentType)
+	json.NewEncoder(w).Encode(v)
+}
+
+func respondErr(w http.ResponseWriter, err error) {
+	respond(w, errorResponse{Err: err.Error()})
+}
+
+func (p *Plugin) handleActivate(w http.ResponseWriter, r *http.Request) {
+	respond(w, struct {
+		Implements []string
+	}{Implements: []string{"VolumeDriver"}})
+}
+
+func (p *Plugin) handleCreate(w http.ResponseWriter, r *http.Request) {
+	var req createRequest
+	if err := decode(r, &req); err != nil {
+		respondErr(w, err)
+		return
+	}
+	ctx := r.Context()
+	id, err := p.mgr.CreateVolume(ctx, req.Name, req.Opts)
+	if err != nil {
+		respondErr(w, err)
+		return
+	}
+
+	p.mu.Lock()
+	v := p.getOrCreateVolume(req.Name)
+	p.mu.Unlock()
+
+	v.mu.Lock()
+	v.id = id
+	v.mu.Unlock()
+
+	respond(w, errorResponse{})
+}
+
+func (p *Plugin) handleRemove(w http.ResponseWriter, r *http.Request) {
+	var req nameRequest
+	if err := decode(r, &req); err != nil {
+		respondErr(w, err)
+		return
+	}
+	ctx := r.Context()
+	id, err := p.mgr.VolumeIDByName(ctx, req.Name)
+	if err != nil {
+		respondErr(w, err)
+		return
+	}
+	if err := p.mgr.RemoveVolume(ctx, id); err != nil {
+		respondErr(w, err)
+		return
+	}
+
+	p.mu.Lock()
+	delete(p.volumes, req.Name)
+	p.mu.Unlock()
+
+	respond(w, errorResponse{})
+}
+
+func (p *Plugin) handleMount(w http.ResponseWriter, r *http.Request) {
+	var req mountRequest
+	if err := decode(r, &req); err != nil {
+		respondErr(w, err)
+		return
+	}
+	target, err := p.mountVolume(r.Context(), req.Name, req.ID)
+	if err != nil {
+		respondErr(w, err)
+		return
+	}
+	respond(w, pathResponse{Mountpoint: target})
+}
+
+func (p *Plugin) handlePath(w http.ResponseWriter, r *http.Request) {
+	var req nameRequest
+	if err := decode(r, &req); err != nil {
+		respondErr(w, err)
+		return
+	}
+	respond(w, pathResponse{Mountpoint: p.targetPath(req.Name)})
+}
+
+func (p *Plugin) handleUnmount(w http.ResponseWriter, r *http.Request) {
+	var req mountRequest
+	if err := decode(r, &req); err != nil {
+		respondErr(w, err)
+		return
+	}
+	if err := p.unmountVolume(r.Context(), req.Name, req.ID); err != nil {
+		respondErr(w, err)
+		return
+	}
+	respond(w, errorResponse{})
+}
+
+func (p *Plugin) handleGet(w http.ResponseWriter, r *http.Request) {
+	var req nameRequest
+	if err := decode(r, &req); err != nil {
+		respondErr(w, err)
+		return
+	}
+
+	p.mu.Lock()
+	v, ok := p.volumes[req.Name]
+	p.mu.Unlock()
+
+	if !ok {
+		respond(w, getResponse{Err: "volume not found: " + req.Name})
+		return
+	}
+
+	info := &volumeInfo{Name: req.Name}
+	if len(v.mounts) > 0 {
+		info.Mountpoint = p.targetPath(req.Name)
+	}
+	respond(w, getResponse{Volume: info})
+}
+
+func (p *Plugin) handleList(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	vols := make([]*volumeInfo, 0, len(p.volumes))
+	for name, v := range p.volumes {
+		info := &volumeInfo{Name: name}
+		if len(v.mounts) > 0 {
+			info.Mountpoint = p.targetPath(name)
+		}
+		vols = append(vols, info)
+	}
+	respond(w, listResponse{Volumes: vols})
+}
+
+func (p *Plugin) handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	var resp capabilitiesResponse
+	resp.Capabilities.Scope = "local"
+	respond(w, resp)
+}
@@ -0,0 +1,146 @@
+package dockerplugin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/thecodeteam/gofsutil"
+
+	"github.com/thecodeteam/csi-scaleio/service"
+)
+
+// defaultFsType is the filesystem ScaleIO volumes are formatted with when
+// mounted through the Docker Volume Plugin, which has no equivalent of a
+// CSI VolumeCapability to negotiate one.
+const defaultFsType = "ext4"
+
+// mountVolume attaches the ScaleIO volume backing name (creating the
+// attachment if this is the first Mount for it) and, if this is the first
+// container to reference it, performs the private mount and bind-mounts
+// it to the volume's target path. It returns the target path Docker
+// should hand to the container.
+func (p *Plugin) mountVolume(ctx context.Context, name, containerID string) (string, error) {
+	v := p.lockVolume(name)
+	defer v.mu.Unlock()
+
+	if v.id == "" {
+		id, err := p.mgr.VolumeIDByName(ctx, name)
+		if err != nil {
+			return "", err
+		}
+		v.id = id
+	}
+
+	target := p.targetPath(name)
+
+	if len(v.mounts) == 0 {
+		device, err := p.mgr.AttachVolume(ctx, v.id)
+		if err != nil {
+			return "", err
+		}
+		v.device = device
+
+		if err := mkdir(target); err != nil {
+			return "", err
+		}
+		if err := p.bindPrivateMount(ctx, device, target); err != nil {
+			return "", err
+		}
+	}
+
+	v.mounts[containerID]++
+	return target, nil
+}
+
+// unmountVolume drops containerID's reference on name's mount. Once the
+// last referencing container unmounts, the target path is unmounted and
+// the volume detached from the SDC, so that concurrent Mount/Unmount
+// pairs for the same volume from different containers don't tear down a
+// still-in-use bind mount.
+func (p *Plugin) unmountVolume(ctx context.Context, name, containerID string) error {
+	p.mu.Lock()
+	v, ok := p.volumes[name]
+	p.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.mounts[containerID] == 0 {
+		return nil
+	}
+
+	v.mounts[containerID]--
+	if v.mounts[containerID] == 0 {
+		delete(v.mounts, containerID)
+	}
+	if len(v.mounts) > 0 {
+		return nil
+	}
+
+	target := p.targetPath(name)
+	if err := gofsutil.Unmount(ctx, target); err != nil {
+		return err
+	}
+
+	// Tear down the private mount bindPrivateMount created before
+	// unmapping the device; otherwise the SDC unmap races a still-mounted
+	// filesystem and the private mount point is leaked.
+	sysDevice, err := service.GetDevice(v.device)
+	if err != nil {
+		return err
+	}
+	privTgt := service.PrivateMountPoint(p.privDir, sysDevice)
+	if err := gofsutil.Unmount(ctx, privTgt); err != nil {
+		return err
+	}
+
+	if err := p.mgr.DetachVolume(ctx, v.id); err != nil {
+		return err
+	}
+	v.device = ""
+	return nil
+}
+
+// bindPrivateMount mounts device to the private mount point shared with
+// the CSI node service, formatting it on first use, then bind-mounts the
+// private mount to target.
+func (p *Plugin) bindPrivateMount(ctx context.Context, device, target string) error {
+	sysDevice, err := service.GetDevice(device)
+	if err != nil {
+		return err
+	}
+	privTgt := service.PrivateMountPoint(p.privDir, sysDevice)
+
+	devMnts, err := gofsutil.GetDevMounts(ctx, sysDevice.RealDev)
+	if err != nil {
+		return err
+	}
+	if len(devMnts) == 0 {
+		if err := mkdir(privTgt); err != nil {
+			return err
+		}
+		if err := gofsutil.FormatAndMount(
+			ctx, sysDevice.FullPath, privTgt, defaultFsType); err != nil {
+			return err
+		}
+	}
+
+	return gofsutil.BindMount(ctx, privTgt, target)
+}
+
+// targetPath returns the plugin-owned directory Docker mounts the named
+// volume at.
+func (p *Plugin) targetPath(name string) string {
+	return filepath.Join(p.root, name)
+}
+
+func mkdir(path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return os.MkdirAll(path, 0755)
+	}
+	return nil
+}
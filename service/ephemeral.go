@@ -0,0 +1,182 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/thecodeteam/gocsi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ephemeralContextKey is the VolumeContext key Kubernetes sets to signal
+// that a NodePublishVolume call is for a CSI ephemeral inline volume: one
+// whose lifecycle is bound to the pod rather than created ahead of time
+// through the controller service.
+const ephemeralContextKey = "csi.storage.k8s.io/ephemeral"
+
+// isEphemeralVolume reports whether a request's VolumeContext marks it as
+// a CSI ephemeral inline volume.
+func isEphemeralVolume(volCtx map[string]string) bool {
+	return volCtx[ephemeralContextKey] == "true"
+}
+
+// EphemeralVolumeManager creates and destroys the ScaleIO volume backing
+// a CSI ephemeral inline volume. The node service owns this lifecycle
+// directly, since the controller-service create path is bypassed for
+// ephemeral volumes.
+type EphemeralVolumeManager interface {
+	CreateVolume(ctx context.Context, name string, opts map[string]string) (id string, err error)
+	RemoveVolume(ctx context.Context, id string) error
+	AttachVolume(ctx context.Context, id string) (device string, err error)
+	DetachVolume(ctx context.Context, id string) error
+}
+
+// ephemeralState is the on-disk record, kept next to the volume's private
+// mount, of the ScaleIO volume ID synthesized for an ephemeral volume.
+// unpublishEphemeralVolume reads it back to find what to unmap and
+// delete, since there's no controller-service record to consult.
+type ephemeralState struct {
+	ScaleIOVolumeID string `json:"scaleIOVolumeID"`
+}
+
+func ephemeralStateFile(privDir, id string) string {
+	return filepath.Join(privDir, id+"-ephemeral.json")
+}
+
+func writeEphemeralState(privDir, id, scaleIOID string) error {
+	b, err := json.Marshal(ephemeralState{ScaleIOVolumeID: scaleIOID})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ephemeralStateFile(privDir, id), b, 0600)
+}
+
+func readEphemeralState(privDir, id string) (*ephemeralState, error) {
+	b, err := ioutil.ReadFile(ephemeralStateFile(privDir, id))
+	if err != nil {
+		return nil, err
+	}
+	var s ephemeralState
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func removeEphemeralState(privDir, id string) error {
+	err := os.Remove(ephemeralStateFile(privDir, id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// publishEphemeralVolume synthesizes a ScaleIO volume from the size,
+// storage pool, and thin/thick parameters passed inline in the request's
+// VolumeContext, maps it to this node via the SDC, records the resulting
+// ScaleIO volume ID for unpublishEphemeralVolume to find, and then runs
+// it through the normal private-mount + bind-mount publish flow.
+func publishEphemeralVolume(
+	ctx context.Context,
+	mgr EphemeralVolumeManager,
+	req *csi.NodePublishVolumeRequest,
+	privDir string) error {
+
+	id := req.GetVolumeId()
+	vc := req.GetVolumeContext()
+
+	opts := map[string]string{
+		"size":        vc["size"],
+		"storagePool": vc["storagePool"],
+		"thin":        vc["thin"],
+	}
+
+	scaleIOID, err := mgr.CreateVolume(ctx, id, opts)
+	if err != nil {
+		return status.Errorf(codes.Internal,
+			"failed to create ephemeral volume: %s", err.Error())
+	}
+
+	if err := writeEphemeralState(privDir, id, scaleIOID); err != nil {
+		return status.Errorf(codes.Internal,
+			"failed to record ephemeral volume state: %s", err.Error())
+	}
+
+	device, err := mgr.AttachVolume(ctx, scaleIOID)
+	if err != nil {
+		return status.Errorf(codes.Internal,
+			"failed to attach ephemeral volume: %s", err.Error())
+	}
+
+	volCap := req.GetVolumeCapability()
+	if volCap == nil {
+		return gocsi.ErrVolumeCapabilityRequired
+	}
+
+	// Ephemeral volumes never go through NodeStageVolume, so the private
+	// mount that publishVolume's bind mount depends on has to be set up
+	// here, immediately after attaching the device.
+	if err := stageDevice(id, volCap, req.GetReadonly(), privDir, device); err != nil {
+		return err
+	}
+
+	return publishVolume(req, privDir, device)
+}
+
+// unpublishEphemeralVolume looks up the ScaleIO volume created for id by
+// publishEphemeralVolume, unmounts it, unmaps it from the SDC, deletes
+// the underlying ScaleIO volume, and removes the recorded state.
+func unpublishEphemeralVolume(
+	ctx context.Context,
+	mgr EphemeralVolumeManager,
+	req *csi.NodeUnpublishVolumeRequest,
+	privDir string) error {
+
+	id := req.GetVolumeId()
+
+	state, err := readEphemeralState(privDir, id)
+	if err != nil {
+		return status.Errorf(codes.Internal,
+			"failed to read ephemeral volume state: %s", err.Error())
+	}
+
+	// The volume is already mapped from publish time, so resolve its
+	// device the same way the normal node path does rather than calling
+	// AttachVolume again: re-mapping an already-mapped ScaleIO volume is
+	// an error on most goscaleio builds, which would abort unpublish
+	// before any cleanup ran and leak the volume and its mount forever.
+	device, err := getSDCDevicePath(state.ScaleIOVolumeID)
+	if err != nil {
+		return status.Errorf(codes.Internal,
+			"failed to resolve ephemeral volume device: %s", err.Error())
+	}
+
+	if err := unpublishVolume(req, device); err != nil {
+		return err
+	}
+
+	// Mirror of the stageDevice call in publishEphemeralVolume: tear down
+	// the private mount before unmapping the device from the SDC, since
+	// nothing else will do it for an ephemeral volume's bypassed stage/
+	// unstage phase.
+	if err := unstageDevice(id, privDir, device); err != nil {
+		return err
+	}
+
+	if err := mgr.DetachVolume(ctx, state.ScaleIOVolumeID); err != nil {
+		return status.Errorf(codes.Internal,
+			"failed to unmap ephemeral volume: %s", err.Error())
+	}
+
+	if err := mgr.RemoveVolume(ctx, state.ScaleIOVolumeID); err != nil {
+		return status.Errorf(codes.Internal,
+			"failed to remove ephemeral volume: %s", err.Error())
+	}
+
+	return removeEphemeralState(privDir, id)
+}
@@ -0,0 +1,32 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsEphemeralVolume(t *testing.T) {
+	assert.True(t, isEphemeralVolume(map[string]string{ephemeralContextKey: "true"}))
+	assert.False(t, isEphemeralVolume(map[string]string{ephemeralContextKey: "false"}))
+	assert.False(t, isEphemeralVolume(nil))
+}
+
+func TestEphemeralStateRoundTrip(t *testing.T) {
+	privDir := t.TempDir()
+
+	assert.NoError(t, writeEphemeralState(privDir, "vol-1", "scaleio-id-1"))
+
+	state, err := readEphemeralState(privDir, "vol-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "scaleio-id-1", state.ScaleIOVolumeID)
+
+	assert.NoError(t, removeEphemeralState(privDir, "vol-1"))
+
+	_, err = readEphemeralState(privDir, "vol-1")
+	assert.Error(t, err)
+}
+
+func TestRemoveEphemeralStateMissingIsNotAnError(t *testing.T) {
+	assert.NoError(t, removeEphemeralState(t.TempDir(), "never-written"))
+}
@@ -0,0 +1,67 @@
+package service
+
+import (
+	"context"
+	"os"
+	"os/exec"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// expandFilesystem grows the filesystem backed by device to consume its
+// full size. xfs can only be grown while mounted, so xfs_growfs takes the
+// private mountpoint; resize2fs, used for ext* filesystems, takes the
+// block device itself and errors out if given a directory.
+func expandFilesystem(ctx context.Context, fs, device, privTgt string) error {
+	var cmd *exec.Cmd
+	if fs == "xfs" {
+		cmd = exec.CommandContext(ctx, "xfs_growfs", privTgt)
+	} else {
+		cmd = exec.CommandContext(ctx, "resize2fs", device)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return status.Errorf(codes.Internal,
+			"failed to expand filesystem on %s: %s: %s",
+			device, err.Error(), string(out))
+	}
+	return nil
+}
+
+// nodeExpandVolume implements NodeExpandVolume. Block volumes need no
+// node-side action, since the SDC already exposes the controller's new
+// device size; filesystem volumes must have their filesystem grown to
+// match once the controller-side resize has completed.
+func nodeExpandVolume(
+	ctx context.Context,
+	req *csi.NodeExpandVolumeRequest,
+	privDir, device string) (*csi.NodeExpandVolumeResponse, error) {
+
+	reqBytes := req.GetCapacityRange().GetRequiredBytes()
+
+	fi, err := os.Stat(req.GetVolumePath())
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound,
+			"could not stat volume path: %s, err: %s",
+			req.GetVolumePath(), err.Error())
+	}
+	if !fi.IsDir() {
+		return &csi.NodeExpandVolumeResponse{CapacityBytes: reqBytes}, nil
+	}
+
+	sysDevice, err := GetDevice(device)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"error getting block device for volume: %s, err: %s",
+			req.GetVolumeId(), err.Error())
+	}
+
+	privTgt := getPrivateMountPoint(privDir, sysDevice)
+	fs := req.GetVolumeCapability().GetMount().GetFsType()
+	if err := expandFilesystem(ctx, fs, sysDevice.RealDev, privTgt); err != nil {
+		return nil, err
+	}
+
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: reqBytes}, nil
+}
@@ -0,0 +1,55 @@
+package service
+
+import "sync"
+
+// volumeLockManager hands out a *sync.Mutex per volume ID, allocating it on
+// first use and freeing it once the last caller to have taken it releases.
+// It is used to serialize the Stage/Publish/Unpublish/Unstage RPCs for a
+// single volume while letting unrelated volumes proceed concurrently,
+// avoiding a single package-wide lock that would otherwise stall unrelated
+// Node RPCs waiting on ScaleIO SDC calls.
+type volumeLockManager struct {
+	mu    sync.Mutex
+	locks map[string]*volumeLock
+}
+
+type volumeLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+func newVolumeLockManager() *volumeLockManager {
+	return &volumeLockManager{locks: map[string]*volumeLock{}}
+}
+
+// lock blocks until the caller holds the lock for id.
+func (m *volumeLockManager) lock(id string) {
+	m.mu.Lock()
+	l, ok := m.locks[id]
+	if !ok {
+		l = &volumeLock{}
+		m.locks[id] = l
+	}
+	l.refs++
+	m.mu.Unlock()
+
+	l.mu.Lock()
+}
+
+// unlock releases the lock for id, held by a prior call to lock. If no
+// other caller is waiting on id, the lock is freed.
+func (m *volumeLockManager) unlock(id string) {
+	m.mu.Lock()
+	l, ok := m.locks[id]
+	if !ok {
+		m.mu.Unlock()
+		return
+	}
+	l.refs--
+	if l.refs == 0 {
+		delete(m.locks, id)
+	}
+	m.mu.Unlock()
+
+	l.mu.Unlock()
+}
@@ -0,0 +1,54 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVolumeLockManagerFreesOnLastUnlock(t *testing.T) {
+	m := newVolumeLockManager()
+
+	m.lock("vol-1")
+	assert.Len(t, m.locks, 1)
+
+	m.unlock("vol-1")
+	assert.Len(t, m.locks, 0)
+}
+
+func TestVolumeLockManagerSerializesSameID(t *testing.T) {
+	m := newVolumeLockManager()
+
+	m.lock("vol-1")
+
+	unlocked := make(chan struct{})
+	go func() {
+		m.lock("vol-1")
+		close(unlocked)
+		m.unlock("vol-1")
+	}()
+
+	select {
+	case <-unlocked:
+		t.Fatal("second lock acquired while first was still held")
+	default:
+	}
+
+	m.unlock("vol-1")
+	<-unlocked
+}
+
+func TestVolumeLockManagerIndependentIDs(t *testing.T) {
+	m := newVolumeLockManager()
+
+	m.lock("vol-1")
+	defer m.unlock("vol-1")
+
+	done := make(chan struct{})
+	go func() {
+		m.lock("vol-2")
+		m.unlock("vol-2")
+		close(done)
+	}()
+	<-done
+}
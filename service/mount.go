@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"syscall"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	log "github.com/sirupsen/logrus"
@@ -14,6 +15,64 @@ import (
 	"google.golang.org/grpc/status"
 )
 
+// mountState describes the condition of a mount point as determined by
+// getMountState.
+type mountState int
+
+const (
+	// mountStateUnmounted means the path does not exist yet.
+	mountStateUnmounted mountState = iota
+	// mountStateMounted means the path exists and is reachable, whether or
+	// not anything is actually mounted there.
+	mountStateMounted
+	// mountStateCorrupted means the path exists but is an endpoint left
+	// behind by a mount whose backing device/server went away (e.g. the
+	// private mount survived a kubelet restart but the device did not).
+	mountStateCorrupted
+)
+
+// getMountState classifies path by attempting to stat it. A missing path
+// is unmounted, a path that stats cleanly is mounted (or at least not
+// known to be broken), and a path whose stat fails with ENOTCONN, ESTALE,
+// EHOSTDOWN, or an I/O error is treated as a corrupted/stale mount left
+// over from a device or transport that has since disappeared.
+func getMountState(path string) (mountState, error) {
+	_, err := os.Stat(path)
+	if err == nil {
+		return mountStateMounted, nil
+	}
+	if os.IsNotExist(err) {
+		return mountStateUnmounted, nil
+	}
+	if isCorruptedMountErr(err) {
+		return mountStateCorrupted, nil
+	}
+	return mountStateUnmounted, err
+}
+
+// isCorruptedMountErr returns true if err indicates that path is a stale
+// or corrupted mount point rather than some other stat failure.
+func isCorruptedMountErr(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	switch err {
+	case syscall.ENOTCONN, syscall.ESTALE, syscall.EIO, syscall.EHOSTDOWN:
+		return true
+	}
+	return false
+}
+
+// recoverCorruptedMount lazily/forcibly unmounts a corrupted mount point so
+// that it can be safely re-mounted.
+func recoverCorruptedMount(path string) error {
+	if err := syscall.Unmount(path, syscall.MNT_FORCE|syscall.MNT_DETACH); err != nil &&
+		err != syscall.EINVAL {
+		return err
+	}
+	return nil
+}
+
 // Device is a struct for holding details about a block device
 type Device struct {
 	FullPath string
@@ -52,29 +111,43 @@ func GetDevice(path string) (*Device, error) {
 	}, nil
 }
 
-// publishVolume uses the parameters in req to bindmount the underlying block
-// device to the requested target path. A private mount is performed first
-// within the given privDir directory.
+// stageVolume uses the parameters in req to mount the underlying block
+// device to the private mount point within the given privDir directory.
+// This is the first of the two phases of the CSI 1.x node plugin RPCs,
+// and must complete before publishVolume is able to bind mount the
+// private mount to a target path.
 //
-// publishVolume handles both Mount and Block access types
-func publishVolume(
-	req *csi.NodePublishVolumeRequest,
+// stageVolume handles both Mount and Block access types
+func stageVolume(
+	req *csi.NodeStageVolumeRequest,
 	privDir, device string) error {
 
-	id := req.GetVolumeId()
-
-	target := req.GetTargetPath()
-	if target == "" {
-		return gocsi.ErrTargetPathRequired
-	}
-
-	ro := req.GetReadonly()
-
 	volCap := req.GetVolumeCapability()
 	if volCap == nil {
 		return gocsi.ErrVolumeCapabilityRequired
 	}
 
+	accMode := volCap.GetAccessMode()
+	if accMode == nil {
+		return gocsi.ErrAccessModeRequired
+	}
+	ro := accMode.GetMode() == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY
+
+	return stageDevice(req.GetVolumeId(), volCap, ro, privDir, device)
+}
+
+// stageDevice performs the private mount described by stageVolume's doc
+// comment, taking its parameters directly rather than a
+// NodeStageVolumeRequest so that callers with no CSI stage request of
+// their own - namely CSI ephemeral inline volumes, which receive only a
+// NodePublishVolumeRequest - can still run the private-mount flow before
+// publishVolume's bind mount.
+func stageDevice(
+	id string,
+	volCap *csi.VolumeCapability,
+	ro bool,
+	privDir, device string) error {
+
 	accMode := volCap.GetAccessMode()
 	if accMode == nil {
 		return gocsi.ErrAccessModeRequired
@@ -88,17 +161,6 @@ func publishVolume(
 			id, err.Error())
 	}
 
-	// make sure target is created
-	tgtStat, err := os.Stat(target)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return status.Errorf(codes.FailedPrecondition,
-				"publish target: %s not pre-created", target)
-		}
-		return status.Errorf(codes.Internal,
-			"failed to stat target, err: %s", err.Error())
-	}
-
 	// make sure privDir exists and is a directory
 	privDirStat, err := os.Stat(privDir)
 	if err != nil {
@@ -136,12 +198,6 @@ func publishVolume(
 		return gocsi.ErrAccessTypeRequired
 	}
 
-	// check that target is right type for vol type
-	if !(tgtStat.IsDir() == !isBlock) {
-		return status.Errorf(codes.FailedPrecondition,
-			"target: %s wrong type (file vs dir) Access Type", target)
-	}
-
 	// Path to mount device to
 	privTgt := getPrivateMountPoint(privDir, sysDevice)
 
@@ -149,7 +205,6 @@ func publishVolume(
 		"id":           id,
 		"volumePath":   sysDevice.FullPath,
 		"device":       sysDevice.RealDev,
-		"target":       target,
 		"privateMount": privTgt,
 	}
 
@@ -177,10 +232,60 @@ func publishVolume(
 			err.Error())
 	}
 
+	// The private mount point may be left behind as a stale/corrupted
+	// mount (e.g. the backing device went away after a kubelet restart).
+	// /proc/mounts can still list it as mounted even though it's
+	// unreachable, so check and repair it before deciding whether
+	// devMnts means the device is genuinely in use elsewhere, rather
+	// than failing with "mount point already in use"/"mounted
+	// elsewhere".
+	for _, m := range devMnts {
+		if m.Path != privTgt {
+			continue
+		}
+		state, err := getMountState(privTgt)
+		if err != nil {
+			return status.Errorf(codes.Internal,
+				"failed to stat private mount point: %s", err.Error())
+		}
+		if state == mountStateCorrupted {
+			log.WithFields(f).Warn(
+				"private mount point is corrupted, recovering")
+			if err := recoverCorruptedMount(privTgt); err != nil {
+				return status.Errorf(codes.Internal,
+					"failed to recover corrupted private mount point: %s",
+					err.Error())
+			}
+			// The private mount is gone now; treat the device as
+			// unmounted so it gets re-mounted below.
+			devMnts = nil
+		}
+		break
+	}
+
 	if len(devMnts) == 0 {
 		// Device isn't mounted anywhere, do the private mount
 		log.WithFields(f).Debug("attempting mount to private area")
 
+		// The private mount point may still be left behind as a stale/
+		// corrupted mount even though the device wasn't found mounted
+		// above (e.g. left over from an entirely different device).
+		// Repair it before touching it further, rather than failing
+		// with "mount point already in use".
+		switch state, err := getMountState(privTgt); {
+		case err != nil:
+			return status.Errorf(codes.Internal,
+				"failed to stat private mount point: %s", err.Error())
+		case state == mountStateCorrupted:
+			log.WithFields(f).Warn(
+				"private mount point is corrupted, recovering")
+			if err := recoverCorruptedMount(privTgt); err != nil {
+				return status.Errorf(codes.Internal,
+					"failed to recover corrupted private mount point: %s",
+					err.Error())
+			}
+		}
+
 		// Make sure private mount point exists
 		var created bool
 		if isBlock {
@@ -260,30 +365,156 @@ func publishVolume(
 		}
 	}
 
-	// Private mount in place, now bind mount to target path
+	return nil
+}
+
+// unstageVolume removes the private mount for the given device, provided
+// it is not also mounted to some other, external target path.
+func unstageVolume(
+	req *csi.NodeUnstageVolumeRequest,
+	privDir, device string) error {
 
-	// If mounts already existed for this device, check if mount to
-	// target path was already there
-	if len(devMnts) > 0 {
-		for _, m := range devMnts {
-			if m.Path == target {
-				// volume already published to target
-				// if mount options look good, do nothing
-				rwo := "rw"
-				if accMode.GetMode() == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY {
-					rwo = "ro"
-				}
-				if !contains(m.Opts, rwo) {
-					return status.Error(codes.Internal,
-						"volume previously published with different options")
+	return unstageDevice(req.GetVolumeId(), privDir, device)
+}
 
-				}
-				// Existing mount satisfies request
-				log.WithFields(f).Debug("volume already published to target")
-				return nil
-			}
+// unstageDevice performs the unmount described by unstageVolume's doc
+// comment, taking the volume ID directly rather than a
+// NodeUnstageVolumeRequest so that callers with no CSI unstage request of
+// their own - namely CSI ephemeral inline volumes - can still tear down
+// the private mount before unmapping/deleting the ScaleIO volume.
+func unstageDevice(id, privDir, device string) error {
+
+	ctx := context.Background()
+
+	// make sure device is valid
+	sysDevice, err := GetDevice(device)
+	if err != nil {
+		return status.Errorf(codes.Internal,
+			"error getting block device for volume: %s, err: %s",
+			id, err.Error())
+	}
+
+	// Path to mount device to
+	privTgt := getPrivateMountPoint(privDir, sysDevice)
+
+	if err := unmountPrivMount(ctx, sysDevice, privTgt); err != nil {
+		return status.Errorf(codes.Internal,
+			"Error unmounting private mount: %s", err.Error())
+	}
+
+	return nil
+}
+
+// publishVolume bind mounts the private mount for the volume, previously
+// created by stageVolume, to the requested target path. For block volumes
+// the target path is a file rather than a directory, following the
+// kubernetes.io/csi/volumeDevices staging convention used by Kubernetes
+// for raw block volumeDevices.
+//
+// publishVolume handles both Mount and Block access types
+func publishVolume(
+	req *csi.NodePublishVolumeRequest,
+	privDir, device string) error {
+
+	id := req.GetVolumeId()
+
+	target := req.GetTargetPath()
+	if target == "" {
+		return gocsi.ErrTargetPathRequired
+	}
+
+	volCap := req.GetVolumeCapability()
+	if volCap == nil {
+		return gocsi.ErrVolumeCapabilityRequired
+	}
+
+	accMode := volCap.GetAccessMode()
+	if accMode == nil {
+		return gocsi.ErrAccessModeRequired
+	}
+
+	// make sure device is valid
+	sysDevice, err := GetDevice(device)
+	if err != nil {
+		return status.Errorf(codes.Internal,
+			"error getting block device for volume: %s, err: %s",
+			id, err.Error())
+	}
+
+	// make sure target is created, repairing it in place if it's a stale
+	// mount left over from a prior publish whose backing mount went away
+	switch state, err := getMountState(target); {
+	case err != nil:
+		return status.Errorf(codes.Internal,
+			"failed to stat target, err: %s", err.Error())
+	case state == mountStateUnmounted:
+		return status.Errorf(codes.FailedPrecondition,
+			"publish target: %s not pre-created", target)
+	case state == mountStateCorrupted:
+		log.WithField("target", target).Warn(
+			"publish target is a corrupted mount, recovering")
+		if err := recoverCorruptedMount(target); err != nil {
+			return status.Errorf(codes.Internal,
+				"failed to recover corrupted target mount: %s", err.Error())
 		}
+	}
 
+	tgtStat, err := os.Stat(target)
+	if err != nil {
+		return status.Errorf(codes.Internal,
+			"failed to stat target, err: %s", err.Error())
+	}
+
+	isBlock := volCap.GetBlock() != nil
+	mntVol := volCap.GetMount()
+
+	if volCap.GetBlock() == nil && mntVol == nil {
+		return gocsi.ErrAccessTypeRequired
+	}
+
+	// check that target is right type for vol type
+	if !(tgtStat.IsDir() == !isBlock) {
+		return status.Errorf(codes.FailedPrecondition,
+			"target: %s wrong type (file vs dir) Access Type", target)
+	}
+
+	// Path to the private mount, created during NodeStageVolume
+	privTgt := getPrivateMountPoint(privDir, sysDevice)
+
+	f := log.Fields{
+		"id":           id,
+		"volumePath":   sysDevice.FullPath,
+		"device":       sysDevice.RealDev,
+		"target":       target,
+		"privateMount": privTgt,
+	}
+
+	ctx := context.Background()
+
+	// If mount to target path already exists, check if options look good
+	// and do nothing, else fail
+	devMnts, err := gofsutil.GetDevMounts(ctx, sysDevice.RealDev)
+	if err != nil {
+		return status.Errorf(codes.Internal,
+			"could not reliably determine existing mount status: %s",
+			err.Error())
+	}
+	for _, m := range devMnts {
+		if m.Path == target {
+			// volume already published to target
+			// if mount options look good, do nothing
+			rwo := "rw"
+			if accMode.GetMode() == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY {
+				rwo = "ro"
+			}
+			if !contains(m.Opts, rwo) {
+				return status.Error(codes.Internal,
+					"volume previously published with different options")
+			}
+			// Existing mount satisfies request
+			log.WithFields(f).Debug("volume already published to target")
+			return nil
+		}
 	}
 
 	var mntFlags []string
@@ -384,13 +615,12 @@ func mkdir(path string) (bool, error) {
 	return false, nil
 }
 
-// unpublishVolume removes the bind mount to the target path, and also removes
-// the mount to the private mount directory if the volume is no longer in use.
-// It determines this by checking to see if the volume is mounted anywhere else
-// other than the private mount.
+// unpublishVolume removes the bind mount to the target path. The private
+// mount created by stageVolume is left in place; it is torn down by
+// unstageVolume once the node is done with the volume entirely.
 func unpublishVolume(
 	req *csi.NodeUnpublishVolumeRequest,
-	privDir, device string) error {
+	device string) error {
 
 	ctx := context.Background()
 	id := req.GetVolumeId()
@@ -408,9 +638,6 @@ func unpublishVolume(
 			id, err.Error())
 	}
 
-	// Path to mount device to
-	privTgt := getPrivateMountPoint(privDir, sysDevice)
-
 	mnts, err := gofsutil.GetMounts(ctx)
 	if err != nil {
 		return status.Errorf(codes.Internal,
@@ -419,14 +646,10 @@ func unpublishVolume(
 	}
 
 	tgtMnt := false
-	privMnt := false
 	for _, m := range mnts {
-		if m.Source == sysDevice.RealDev || m.Device == sysDevice.RealDev {
-			if m.Path == privTgt {
-				privMnt = true
-			} else if m.Path == target {
-				tgtMnt = true
-			}
+		if (m.Source == sysDevice.RealDev || m.Device == sysDevice.RealDev) &&
+			m.Path == target {
+			tgtMnt = true
 		}
 	}
 
@@ -437,13 +660,6 @@ func unpublishVolume(
 		}
 	}
 
-	if privMnt {
-		if err := unmountPrivMount(ctx, sysDevice, privTgt); err != nil {
-			return status.Errorf(codes.Internal,
-				"Error unmounting private mount: %s", err.Error())
-		}
-	}
-
 	return nil
 }
 
@@ -475,3 +691,11 @@ func unmountPrivMount(
 	}
 	return nil
 }
+
+// PrivateMountPoint returns the path within privDir where dev's private
+// mount lives. It is exported so that callers outside this package, such
+// as the dockerplugin adapter, can lay out the same private-mount
+// directory structure used by the CSI node service.
+func PrivateMountPoint(privDir string, dev *Device) string {
+	return getPrivateMountPoint(privDir, dev)
+}
@@ -0,0 +1,30 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetMountStateUnmounted(t *testing.T) {
+	state, err := getMountState(filepath.Join(t.TempDir(), "does-not-exist"))
+	assert.NoError(t, err)
+	assert.Equal(t, mountStateUnmounted, state)
+}
+
+func TestGetMountStateMounted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "exists")
+	assert.NoError(t, os.Mkdir(path, 0755))
+
+	state, err := getMountState(path)
+	assert.NoError(t, err)
+	assert.Equal(t, mountStateMounted, state)
+}
+
+func TestIsCorruptedMountErr(t *testing.T) {
+	assert.True(t, isCorruptedMountErr(&os.PathError{Err: syscall.ENOTCONN}))
+	assert.False(t, isCorruptedMountErr(os.ErrNotExist))
+}
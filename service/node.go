@@ -0,0 +1,245 @@
+package service
+
+import (
+	"context"
+	"os"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/thecodeteam/gocsi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// service implements the CSI Node gRPC service. privDir is the plugin's
+// private mount directory, and volLocks serializes the Stage/Publish/
+// Unpublish/Unstage RPCs on a per-volume-ID basis so that concurrent Node
+// RPCs for the same volume don't race each other while unrelated volumes
+// are handled concurrently. ephemeralMgr backs CSI ephemeral inline
+// volumes, whose ScaleIO volume is created and destroyed by the node
+// service itself rather than through the controller service.
+type service struct {
+	privDir      string
+	volLocks     *volumeLockManager
+	ephemeralMgr EphemeralVolumeManager
+}
+
+// New returns a csi.NodeServer backed by the ScaleIO driver. privDir is
+// the plugin's private mount directory, and ephemeralMgr creates and
+// destroys the ScaleIO volumes backing CSI ephemeral inline volumes.
+func New(privDir string, ephemeralMgr EphemeralVolumeManager) csi.NodeServer {
+	return &service{
+		privDir:      privDir,
+		volLocks:     newVolumeLockManager(),
+		ephemeralMgr: ephemeralMgr,
+	}
+}
+
+// NodeStageVolume mounts the volume's underlying block device to the
+// plugin's private mount directory.
+func (s *service) NodeStageVolume(
+	ctx context.Context,
+	req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+
+	id := req.GetVolumeId()
+	if id == "" {
+		return nil, gocsi.ErrVolumeIDRequired
+	}
+
+	s.volLocks.lock(id)
+	defer s.volLocks.unlock(id)
+
+	device, err := s.getDevicePath(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := stageVolume(req, s.privDir, device); err != nil {
+		return nil, err
+	}
+
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+// NodeUnstageVolume removes the private mount created by NodeStageVolume.
+func (s *service) NodeUnstageVolume(
+	ctx context.Context,
+	req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+
+	id := req.GetVolumeId()
+	if id == "" {
+		return nil, gocsi.ErrVolumeIDRequired
+	}
+
+	s.volLocks.lock(id)
+	defer s.volLocks.unlock(id)
+
+	device, err := s.getDevicePath(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := unstageVolume(req, s.privDir, device); err != nil {
+		return nil, err
+	}
+
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+// NodePublishVolume bind mounts the volume's private mount to the
+// requested target path. CSI ephemeral inline volumes, identified by the
+// "csi.storage.k8s.io/ephemeral" VolumeContext entry, instead have their
+// backing ScaleIO volume created and attached here directly, since the
+// controller service's CreateVolume is never called for them.
+func (s *service) NodePublishVolume(
+	ctx context.Context,
+	req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+
+	id := req.GetVolumeId()
+	if id == "" {
+		return nil, gocsi.ErrVolumeIDRequired
+	}
+
+	s.volLocks.lock(id)
+	defer s.volLocks.unlock(id)
+
+	if isEphemeralVolume(req.GetVolumeContext()) {
+		if err := publishEphemeralVolume(ctx, s.ephemeralMgr, req, s.privDir); err != nil {
+			return nil, err
+		}
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	device, err := s.getDevicePath(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := publishVolume(req, s.privDir, device); err != nil {
+		return nil, err
+	}
+
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// NodeUnpublishVolume removes the bind mount at the target path. For a
+// CSI ephemeral inline volume it also unmaps and deletes the ScaleIO
+// volume created for it by NodePublishVolume.
+func (s *service) NodeUnpublishVolume(
+	ctx context.Context,
+	req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+
+	id := req.GetVolumeId()
+	if id == "" {
+		return nil, gocsi.ErrVolumeIDRequired
+	}
+
+	s.volLocks.lock(id)
+	defer s.volLocks.unlock(id)
+
+	if _, err := readEphemeralState(s.privDir, id); err == nil {
+		if err := unpublishEphemeralVolume(ctx, s.ephemeralMgr, req, s.privDir); err != nil {
+			return nil, err
+		}
+		return &csi.NodeUnpublishVolumeResponse{}, nil
+	}
+
+	device, err := s.getDevicePath(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := unpublishVolume(req, device); err != nil {
+		return nil, err
+	}
+
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+// NodeGetVolumeStats reports capacity/usage for a published volume,
+// whether it's a filesystem mount or a raw block device published under
+// the kubernetes.io/csi/volumeDevices staging convention.
+func (s *service) NodeGetVolumeStats(
+	ctx context.Context,
+	req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+
+	id := req.GetVolumeId()
+	if id == "" {
+		return nil, gocsi.ErrVolumeIDRequired
+	}
+
+	device, err := s.getDevicePath(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return nodeGetVolumeStats(req, device)
+}
+
+// NodeExpandVolume grows a filesystem volume's filesystem to match a
+// completed controller-side ScaleIO volume resize. Block volumes are a
+// no-op since the SDC already exposes the larger device.
+func (s *service) NodeExpandVolume(
+	ctx context.Context,
+	req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+
+	id := req.GetVolumeId()
+	if id == "" {
+		return nil, gocsi.ErrVolumeIDRequired
+	}
+
+	s.volLocks.lock(id)
+	defer s.volLocks.unlock(id)
+
+	device, err := s.getDevicePath(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return nodeExpandVolume(ctx, req, s.privDir, device)
+}
+
+// NodeGetCapabilities returns the capabilities supported by this node
+// service. CSI ephemeral inline volume support doesn't add an RPC
+// capability of its own; Kubernetes discovers it from the CSIDriver
+// object's volumeLifecycleModes rather than a NodeGetCapabilities entry.
+func (s *service) NodeGetCapabilities(
+	ctx context.Context,
+	req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+
+	caps := []csi.NodeServiceCapability_RPC_Type{
+		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+		csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+	}
+
+	rpcCaps := make([]*csi.NodeServiceCapability, len(caps))
+	for i, c := range caps {
+		rpcCaps[i] = &csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{Type: c},
+			},
+		}
+	}
+
+	return &csi.NodeGetCapabilitiesResponse{Capabilities: rpcCaps}, nil
+}
+
+// NodeGetInfo returns this node's ID, used by the controller service to
+// target ScaleIO SDC mapping calls at the right node.
+func (s *service) NodeGetInfo(
+	ctx context.Context,
+	req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"failed to get node id: %s", err.Error())
+	}
+	return &csi.NodeGetInfoResponse{NodeId: hostname}, nil
+}
+
+// getDevicePath resolves the local block device path for the SDC-mapped
+// ScaleIO volume with the given ID.
+func (s *service) getDevicePath(id string) (string, error) {
+	return getSDCDevicePath(id)
+}
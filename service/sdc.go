@@ -0,0 +1,25 @@
+package service
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// sdcDeviceDir is where the ScaleIO SDC kernel module creates stable
+// symlinks to the volumes it has mapped to this node.
+const sdcDeviceDir = "/dev/disk/by-id"
+
+// getSDCDevicePath resolves the local block device the SDC has mapped
+// ScaleIO volume id to. The SDC has no lookup-by-volume-ID API of its
+// own, so this relies on the emc-vol-<systemID>-<volumeID> symlink
+// naming convention it creates under /dev/disk/by-id.
+func getSDCDevicePath(id string) (string, error) {
+	matches, err := filepath.Glob(filepath.Join(sdcDeviceDir, "emc-vol-*-"+id))
+	if err != nil {
+		return "", err
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("no SDC-mapped device found for volume: %s", id)
+	}
+	return matches[0], nil
+}
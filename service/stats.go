@@ -0,0 +1,104 @@
+package service
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// blkGetSize64 is the ioctl request number for BLKGETSIZE64, which reads
+// the size, in bytes, of a block device.
+const blkGetSize64 = 0x80081272
+
+// getBlockDeviceSize returns the size in bytes of the block device at path.
+func getBlockDeviceSize(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var size int64
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL, f.Fd(), blkGetSize64, uintptr(unsafe.Pointer(&size)))
+	if errno != 0 {
+		return 0, errno
+	}
+	return size, nil
+}
+
+// getFilesystemStats returns the capacity and available bytes for the
+// filesystem mounted at path, determined via statfs(2).
+func getFilesystemStats(path string) (capacity, available int64, err error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, err
+	}
+	capacity = int64(stat.Blocks) * int64(stat.Bsize)
+	available = int64(stat.Bavail) * int64(stat.Bsize)
+	return capacity, available, nil
+}
+
+// nodeGetVolumeStats implements NodeGetVolumeStats for both filesystem
+// mounts, reported via statfs(2), and raw block devices, reported via the
+// BLKGETSIZE64 ioctl against the SDC-mapped device.
+func nodeGetVolumeStats(
+	req *csi.NodeGetVolumeStatsRequest, device string) (*csi.NodeGetVolumeStatsResponse, error) {
+
+	id := req.GetVolumeId()
+
+	path := req.GetVolumePath()
+	if path == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume path required")
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound,
+			"could not stat volume path: %s, err: %s", path, err.Error())
+	}
+
+	if fi.IsDir() {
+		capacity, available, err := getFilesystemStats(path)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal,
+				"failed to get filesystem stats for volume: %s, err: %s",
+				id, err.Error())
+		}
+		return &csi.NodeGetVolumeStatsResponse{
+			Usage: []*csi.VolumeUsage{
+				{
+					Unit:      csi.VolumeUsage_BYTES,
+					Total:     capacity,
+					Available: available,
+					Used:      capacity - available,
+				},
+			},
+		}, nil
+	}
+
+	sysDevice, err := GetDevice(device)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"error getting block device for volume: %s, err: %s",
+			id, err.Error())
+	}
+	size, err := getBlockDeviceSize(sysDevice.RealDev)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"failed to get block device size for volume: %s, err: %s",
+			id, err.Error())
+	}
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{
+			{
+				Unit:  csi.VolumeUsage_BYTES,
+				Total: size,
+			},
+		},
+	}, nil
+}